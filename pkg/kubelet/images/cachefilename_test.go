@@ -0,0 +1,32 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package images
+
+import "testing"
+
+// TestCacheFileNameDoesNotCollideOnUnderscoreVsSlash guards against a
+// collision a plain "/" -> "_" substitution would have caused: '_' is a
+// legal character in a Docker repository path, so "reg.io/foo/bar:tag"
+// and "reg.io/foo_bar:tag" are distinct, real references that must not
+// flatten to the same on-disk file name.
+func TestCacheFileNameDoesNotCollideOnUnderscoreVsSlash(t *testing.T) {
+	a := cacheFileName("reg.io/foo/bar:tag")
+	b := cacheFileName("reg.io/foo_bar:tag")
+	if a == b {
+		t.Errorf("cacheFileName collided for distinct keys %q and %q: both produced %q", "reg.io/foo/bar:tag", "reg.io/foo_bar:tag", a)
+	}
+}
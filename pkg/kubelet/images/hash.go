@@ -0,0 +1,127 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package images
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// authHashVersion prefixes every hash this package produces, so a
+	// future change to the hashing scheme can tell its own output apart
+	// from an older node's and treat the old form as expired rather than
+	// silently miscomparing.
+	authHashVersion = "v1"
+	// authSaltFileName holds the per-node random salt, stored alongside
+	// the image state directory so it survives kubelet restarts but
+	// never leaves the node.
+	authSaltFileName = ".auth-salt"
+	authSaltSize     = 32
+)
+
+// AuthHasher computes the stable, salted hash used as the key under which
+// an EnsuredInfo is stored for a given credential. Hashing a fixed-order
+// canonical form of the credential means two callers holding the same field
+// values always agree on the hash; the field values themselves are hashed as
+// given, with no further normalization (e.g. of the ServerAddress spelling).
+// Salting it with a per-node secret
+// means a leaked state file can't be brute-forced against a known
+// credential set.
+type AuthHasher struct {
+	mu   sync.RWMutex
+	salt []byte
+}
+
+// NewAuthHasher returns an AuthHasher whose salt is loaded from saltDir,
+// generating and persisting a new random salt there on first run.
+func NewAuthHasher(saltDir string) (*AuthHasher, error) {
+	salt, err := loadOrCreateAuthSalt(filepath.Join(saltDir, authSaltFileName))
+	if err != nil {
+		return nil, err
+	}
+	return &AuthHasher{salt: salt}, nil
+}
+
+// canonicalAuth is the JSON form an Auth is hashed in: a fixed field order
+// and fixed field set so that two Auth values with the same meaning always
+// serialize identically.
+type canonicalAuth struct {
+	Registry      string `json:"registry"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identityToken"`
+}
+
+// Hash returns the versioned, salted hash for auth, e.g. "v1:3a5c...".
+func (h *AuthHasher) Hash(auth Auth) (string, error) {
+	canon := canonicalAuth{
+		Registry:      auth.ServerAddress,
+		Username:      auth.Username,
+		Password:      auth.Password,
+		IdentityToken: auth.IdentityToken,
+	}
+	data, err := json.Marshal(canon)
+	if err != nil {
+		return "", err
+	}
+
+	h.mu.RLock()
+	salt := h.salt
+	h.mu.RUnlock()
+
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(data)
+	return authHashVersion + ":" + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// isSupportedAuthHash reports whether hash carries a version prefix this
+// build knows how to compare against. Entries with an unrecognized prefix
+// (produced by an older or newer hashing scheme, or corrupt) are treated as
+// expired rather than trusted.
+func isSupportedAuthHash(hash string) bool {
+	return strings.HasPrefix(hash, authHashVersion+":")
+}
+
+func loadOrCreateAuthSalt(path string) ([]byte, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		salt, decodeErr := hex.DecodeString(strings.TrimSpace(string(data)))
+		if decodeErr != nil {
+			return nil, fmt.Errorf("corrupt auth salt file %s: %w", path, decodeErr)
+		}
+		return salt, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	salt := make([]byte, authSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if err := atomicWriteFile(path, []byte(hex.EncodeToString(salt)), 0600); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package images
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuthHasherSemanticallyIdenticalAuthsCollide(t *testing.T) {
+	hasher, err := NewAuthHasher(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthHasher returned error: %v", err)
+	}
+
+	a := Auth{Username: "alice", Password: "hunter2", ServerAddress: "registry.example.com"}
+	b := Auth{ServerAddress: "registry.example.com", Password: "hunter2", Username: "alice"}
+
+	hashA, err := hasher.Hash(a)
+	if err != nil {
+		t.Fatalf("Hash(a) returned error: %v", err)
+	}
+	hashB, err := hasher.Hash(b)
+	if err != nil {
+		t.Fatalf("Hash(b) returned error: %v", err)
+	}
+	if hashA != hashB {
+		t.Errorf("two syntactically-different-but-equal Auth values hashed differently: %q vs %q", hashA, hashB)
+	}
+	if !strings.HasPrefix(hashA, authHashVersion+":") {
+		t.Errorf("hash %q missing version prefix %q", hashA, authHashVersion+":")
+	}
+}
+
+func TestAuthHasherDifferentRegistryHostsNeverCollide(t *testing.T) {
+	hasher, err := NewAuthHasher(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthHasher returned error: %v", err)
+	}
+
+	base := Auth{Username: "alice", Password: "hunter2", ServerAddress: "registry-a.example.com"}
+	other := base
+	other.ServerAddress = "registry-b.example.com"
+
+	hashBase, err := hasher.Hash(base)
+	if err != nil {
+		t.Fatalf("Hash(base) returned error: %v", err)
+	}
+	hashOther, err := hasher.Hash(other)
+	if err != nil {
+		t.Fatalf("Hash(other) returned error: %v", err)
+	}
+	if hashBase == hashOther {
+		t.Errorf("Auth values for different registry hosts hashed to the same value %q", hashBase)
+	}
+}
+
+func TestAuthHasherDifferentCredentialsNeverCollide(t *testing.T) {
+	hasher, err := NewAuthHasher(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthHasher returned error: %v", err)
+	}
+
+	base := Auth{Username: "alice", Password: "hunter2", ServerAddress: "registry.example.com"}
+	other := base
+	other.Password = "different"
+
+	hashBase, err := hasher.Hash(base)
+	if err != nil {
+		t.Fatalf("Hash(base) returned error: %v", err)
+	}
+	hashOther, err := hasher.Hash(other)
+	if err != nil {
+		t.Fatalf("Hash(other) returned error: %v", err)
+	}
+	if hashBase == hashOther {
+		t.Errorf("Auth values with different passwords hashed to the same value %q", hashBase)
+	}
+}
+
+func TestAuthHasherSaltPersistsAcrossInstances(t *testing.T) {
+	dir := t.TempDir()
+	auth := Auth{Username: "alice", Password: "hunter2", ServerAddress: "registry.example.com"}
+
+	first, err := NewAuthHasher(dir)
+	if err != nil {
+		t.Fatalf("NewAuthHasher returned error: %v", err)
+	}
+	firstHash, err := first.Hash(auth)
+	if err != nil {
+		t.Fatalf("Hash returned error: %v", err)
+	}
+
+	second, err := NewAuthHasher(dir)
+	if err != nil {
+		t.Fatalf("NewAuthHasher returned error: %v", err)
+	}
+	secondHash, err := second.Hash(auth)
+	if err != nil {
+		t.Fatalf("Hash returned error: %v", err)
+	}
+
+	if firstHash != secondHash {
+		t.Errorf("hash changed across AuthHasher instances sharing a salt directory: %q vs %q", firstHash, secondHash)
+	}
+}
+
+func TestIsSupportedAuthHash(t *testing.T) {
+	tests := []struct {
+		hash string
+		want bool
+	}{
+		{hash: authHashVersion + ":abc123", want: true},
+		{hash: "v0:abc123", want: false},
+		{hash: "abc123", want: false},
+		{hash: "", want: false},
+	}
+	for _, tt := range tests {
+		if got := isSupportedAuthHash(tt.hash); got != tt.want {
+			t.Errorf("isSupportedAuthHash(%q) = %v, want %v", tt.hash, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package images
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// defaultRegistry is substituted for imageRefs with no explicit
+	// registry host, mirroring the expansion the container runtime and
+	// github.com/google/go-containerregistry/pkg/name both apply for
+	// Docker Hub shorthands.
+	defaultRegistry = "index.docker.io"
+	// defaultRepositoryPrefix is prepended to single-segment repositories
+	// resolved against defaultRegistry (e.g. "nginx" -> "library/nginx").
+	defaultRepositoryPrefix = "library/"
+	defaultTag              = "latest"
+)
+
+// imageReference is the parsed form of an imageRef: a registry host, a
+// repository path, and either a tag or a digest (never both once
+// normalized; a digest takes precedence, see parseImageReference).
+type imageReference struct {
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+// canonical renders the reference back into the normalized string used as
+// both the cache map key and the on-disk file name.
+func (r imageReference) canonical() string {
+	if r.digest != "" {
+		return fmt.Sprintf("%s/%s@%s", r.registry, r.repository, r.digest)
+	}
+	tag := r.tag
+	if tag == "" {
+		tag = defaultTag
+	}
+	return fmt.Sprintf("%s/%s:%s", r.registry, r.repository, tag)
+}
+
+// NormalizeImageRef parses imageRef the way the container runtime resolves
+// it (expanding Docker Hub shorthands and applying the implicit "latest"
+// tag) and returns a canonical "registry/repository[:tag|@digest]" string.
+// Two different spellings of the same image (e.g. "nginx:latest" and
+// "docker.io/library/nginx:latest") normalize to the same value, so they
+// share one ImagePullInfo entry instead of tracking auth state twice.
+func NormalizeImageRef(imageRef string) (string, error) {
+	ref, err := parseImageReference(imageRef)
+	if err != nil {
+		return "", err
+	}
+	return ref.canonical(), nil
+}
+
+func parseImageReference(imageRef string) (imageReference, error) {
+	if imageRef == "" {
+		return imageReference{}, fmt.Errorf("image reference must not be empty")
+	}
+
+	working := imageRef
+	digest := ""
+	if at := strings.Index(working, "@"); at != -1 {
+		digest = working[at+1:]
+		working = working[:at]
+		if !strings.Contains(digest, ":") {
+			return imageReference{}, fmt.Errorf("invalid digest %q in image reference %q", digest, imageRef)
+		}
+	}
+	if working == "" {
+		return imageReference{}, fmt.Errorf("invalid image reference %q: missing repository", imageRef)
+	}
+
+	registry := defaultRegistry
+	repository := working
+	if slash := strings.Index(working, "/"); slash != -1 && looksLikeRegistryHost(working[:slash]) {
+		registry = working[:slash]
+		repository = working[slash+1:]
+	}
+	// "docker.io" is just the historical, user-facing spelling of the
+	// default registry host; canonicalize it so it shares cache entries
+	// with the implicit-registry and "index.docker.io" spellings.
+	if registry == "docker.io" {
+		registry = defaultRegistry
+	}
+
+	tag := ""
+	// A ':' only introduces a tag in the final path segment, so it isn't
+	// confused with a port number on the registry host (e.g.
+	// "localhost:5000/foo").
+	if colon := strings.LastIndex(repository, ":"); colon != -1 && !strings.Contains(repository[colon:], "/") {
+		tag = repository[colon+1:]
+		repository = repository[:colon]
+	}
+	if repository == "" {
+		return imageReference{}, fmt.Errorf("invalid image reference %q: missing repository", imageRef)
+	}
+	if registry == defaultRegistry && !strings.Contains(repository, "/") {
+		repository = defaultRepositoryPrefix + repository
+	}
+
+	// A digest pins the content exactly; prefer it over any tag present
+	// alongside it (e.g. "nginx:latest@sha256:...") so the cache key is
+	// the strongest identifier available.
+	if digest != "" {
+		tag = ""
+	}
+
+	return imageReference{registry: registry, repository: repository, tag: tag, digest: digest}, nil
+}
+
+// looksLikeRegistryHost reports whether s (the first path segment of an
+// imageRef) is a registry host rather than the start of a repository path,
+// using the same heuristic as Docker: it must contain a '.', a ':'
+// (port), or be exactly "localhost".
+func looksLikeRegistryHost(s string) bool {
+	return s == "localhost" || strings.ContainsAny(s, ".:")
+}
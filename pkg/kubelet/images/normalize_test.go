@@ -0,0 +1,123 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package images
+
+import "testing"
+
+func TestNormalizeImageRef(t *testing.T) {
+	tests := []struct {
+		name    string
+		ref     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "bare docker hub shortname",
+			ref:  "nginx",
+			want: "index.docker.io/library/nginx:latest",
+		},
+		{
+			name: "docker hub shortname with tag",
+			ref:  "nginx:1.25",
+			want: "index.docker.io/library/nginx:1.25",
+		},
+		{
+			name: "docker hub namespaced repository",
+			ref:  "myorg/myapp:v1",
+			want: "index.docker.io/myorg/myapp:v1",
+		},
+		{
+			name: "fully qualified docker hub reference",
+			ref:  "docker.io/library/nginx:latest",
+			want: "index.docker.io/library/nginx:latest",
+		},
+		{
+			name: "mirror registry with port",
+			ref:  "localhost:5000/myapp:v1",
+			want: "localhost:5000/myapp:v1",
+		},
+		{
+			name: "mirror registry with dotted host and no tag",
+			ref:  "registry.internal.example.com/team/app",
+			want: "registry.internal.example.com/team/app:latest",
+		},
+		{
+			name: "tag and digest combination prefers digest",
+			ref:  "nginx:latest@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			want: "index.docker.io/library/nginx@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+		{
+			name: "digest only, fully qualified",
+			ref:  "index.docker.io/library/nginx@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			want: "index.docker.io/library/nginx@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+		{
+			name:    "empty reference is invalid",
+			ref:     "",
+			wantErr: true,
+		},
+		{
+			name:    "malformed digest is invalid",
+			ref:     "nginx@not-a-digest",
+			wantErr: true,
+		},
+		{
+			name:    "missing repository is invalid",
+			ref:     "docker.io/",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeImageRef(tt.ref)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("NormalizeImageRef(%q) = %q, want error", tt.ref, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NormalizeImageRef(%q) returned unexpected error: %v", tt.ref, err)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeImageRef(%q) = %q, want %q", tt.ref, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeImageRefEquivalentSpellings(t *testing.T) {
+	a, err := NormalizeImageRef("nginx:latest")
+	if err != nil {
+		t.Fatalf("NormalizeImageRef returned error: %v", err)
+	}
+	b, err := NormalizeImageRef("docker.io/library/nginx:latest")
+	if err != nil {
+		t.Fatalf("NormalizeImageRef returned error: %v", err)
+	}
+	c, err := NormalizeImageRef("index.docker.io/library/nginx:latest")
+	if err != nil {
+		t.Fatalf("NormalizeImageRef returned error: %v", err)
+	}
+	if a != c {
+		t.Errorf("normalized %q and %q should match, got %q and %q", "nginx:latest", "index.docker.io/library/nginx:latest", a, c)
+	}
+	if b != c {
+		t.Errorf("normalized %q and %q should match, got %q and %q", "docker.io/library/nginx:latest", "index.docker.io/library/nginx:latest", b, c)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package images
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Auth describes the registry credential a pull was (or will be) attempted
+// with. It mirrors the subset of a docker config auth entry the cache's
+// auth-hash tracking and the pull-through cache backend both need.
+type Auth struct {
+	Username      string
+	Password      string
+	IdentityToken string
+	ServerAddress string
+}
+
+// PullThroughCache lets the image manager route a pull through a node-local
+// or cluster-local registry mirror instead of always hitting the upstream
+// registry directly, the same way an in-cluster pull-through caching proxy
+// would. Implementations must be safe for concurrent use.
+type PullThroughCache interface {
+	// Resolve returns the imageRef the kubelet should hand to the CRI
+	// runtime's PullImage in place of imageRef, e.g. an equivalent
+	// reference hosted on a local mirror. Implementations that can't
+	// offer a mirrored reference return imageRef itself.
+	Resolve(imageRef string, auth Auth) (mirroredRef string, err error)
+	// Warm primes the mirror for imageRef so a subsequent Resolve can be
+	// served without the mirror itself needing to pull from upstream.
+	Warm(imageRef string, auth Auth) error
+}
+
+// passthroughPullCache is the default PullThroughCache: it never mirrors,
+// it always resolves to the original, upstream imageRef.
+type passthroughPullCache struct{}
+
+// NewPassthroughPullCache returns a PullThroughCache that always resolves
+// to the original imageRef, i.e. behaves as if no mirror were configured.
+func NewPassthroughPullCache() PullThroughCache {
+	return passthroughPullCache{}
+}
+
+func (passthroughPullCache) Resolve(imageRef string, _ Auth) (string, error) {
+	return imageRef, nil
+}
+
+func (passthroughPullCache) Warm(string, Auth) error {
+	return nil
+}
+
+// MirrorConfig configures a rewriteHostPullCache's target registry mirror.
+type MirrorConfig struct {
+	// Host replaces the registry component of a normalized image
+	// reference, e.g. "mirror.example.com:5000".
+	Host string
+	// Insecure allows the kubelet to reach Host over plain HTTP or with
+	// an unverified TLS certificate.
+	Insecure bool
+	// CAFile, if set, is a PEM bundle used to verify Host's certificate.
+	CAFile string
+	// Username and Password, if set, authenticate to Host itself (the
+	// mirror's own credential, independent of the per-pull Auth passed
+	// to Resolve/Warm).
+	Username string
+	Password string
+}
+
+// rewriteHostPullCache is a PullThroughCache that swaps the registry
+// component of a normalized image reference for a configured mirror host.
+type rewriteHostPullCache struct {
+	mirror MirrorConfig
+}
+
+// NewRewriteHostPullCache returns a PullThroughCache that resolves every
+// imageRef to the equivalent reference on mirror.Host, falling back to the
+// original, upstream imageRef if the reference can't be parsed.
+func NewRewriteHostPullCache(mirror MirrorConfig) (PullThroughCache, error) {
+	if mirror.Host == "" {
+		return nil, fmt.Errorf("mirror host must not be empty")
+	}
+	return &rewriteHostPullCache{mirror: mirror}, nil
+}
+
+func (r *rewriteHostPullCache) Resolve(imageRef string, _ Auth) (string, error) {
+	key, err := NormalizeImageRef(imageRef)
+	if err != nil {
+		// Can't parse it to rewrite; fall back to the origin registry
+		// rather than fail the pull outright.
+		return imageRef, err
+	}
+	slash := strings.Index(key, "/")
+	if slash == -1 {
+		return imageRef, fmt.Errorf("invalid normalized image reference %q", key)
+	}
+	return r.mirror.Host + key[slash:], nil
+}
+
+// Warm issues a HEAD request for mirroredRef's manifest against the mirror,
+// the same trigger a registry pull-through proxy (e.g. registry:2 run as a
+// mirror) uses to fetch and cache an image from upstream on first request,
+// so that the pod whose pull actually requested it doesn't pay that latency
+// through Resolve.
+func (r *rewriteHostPullCache) Warm(imageRef string, auth Auth) error {
+	mirroredRef, err := r.Resolve(imageRef, auth)
+	if err != nil {
+		return err
+	}
+
+	url, err := manifestURL(mirroredRef, r.mirror.Insecure)
+	if err != nil {
+		return err
+	}
+	client, err := r.httpClient()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	if r.mirror.Username != "" {
+		req.SetBasicAuth(r.mirror.Username, r.mirror.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to warm mirror for %s: %w", imageRef, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("mirror returned %s warming %s", resp.Status, imageRef)
+	}
+	return nil
+}
+
+// httpClient builds the client Warm uses to reach the mirror, applying the
+// configured CA bundle and TLS verification policy.
+func (r *rewriteHostPullCache) httpClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: r.mirror.Insecure}
+	if r.mirror.CAFile != "" {
+		pemData, err := os.ReadFile(r.mirror.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mirror CA file %s: %w", r.mirror.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in mirror CA file %s", r.mirror.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// manifestURL turns a normalized "host/repository[:tag|@digest]" reference
+// into the registry v2 manifest URL used to address it on the mirror.
+func manifestURL(normalizedRef string, insecure bool) (string, error) {
+	slash := strings.Index(normalizedRef, "/")
+	if slash == -1 {
+		return "", fmt.Errorf("invalid normalized image reference %q", normalizedRef)
+	}
+	host := normalizedRef[:slash]
+	rest := normalizedRef[slash+1:]
+
+	repo, ref := rest, defaultTag
+	if at := strings.LastIndex(rest, "@"); at != -1 {
+		repo, ref = rest[:at], rest[at+1:]
+	} else if colon := strings.LastIndex(rest, ":"); colon != -1 {
+		repo, ref = rest[:colon], rest[colon+1:]
+	}
+
+	scheme := "https"
+	if insecure {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, host, repo, ref), nil
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package images
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRewriteHostPullCacheResolve(t *testing.T) {
+	cache, err := NewRewriteHostPullCache(MirrorConfig{Host: "mirror.example.com:5000"})
+	if err != nil {
+		t.Fatalf("NewRewriteHostPullCache returned error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		ref  string
+		want string
+	}{
+		{name: "docker hub shortname", ref: "nginx:latest", want: "mirror.example.com:5000/library/nginx:latest"},
+		{name: "namespaced repository", ref: "myorg/myapp:v1", want: "mirror.example.com:5000/myorg/myapp:v1"},
+		{name: "digest reference", ref: "nginx@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", want: "mirror.example.com:5000/library/nginx@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cache.Resolve(tt.ref, Auth{})
+			if err != nil {
+				t.Fatalf("Resolve(%q) returned error: %v", tt.ref, err)
+			}
+			if got != tt.want {
+				t.Errorf("Resolve(%q) = %q, want %q", tt.ref, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteHostPullCacheResolveFallsBackToOriginOnInvalidRef(t *testing.T) {
+	cache, err := NewRewriteHostPullCache(MirrorConfig{Host: "mirror.example.com:5000"})
+	if err != nil {
+		t.Fatalf("NewRewriteHostPullCache returned error: %v", err)
+	}
+
+	const invalidRef = "nginx@not-a-digest"
+	got, err := cache.Resolve(invalidRef, Auth{})
+	if err == nil {
+		t.Fatalf("Resolve(%q) = %q, want an error", invalidRef, got)
+	}
+	if got != invalidRef {
+		t.Errorf("Resolve(%q) on failure = %q, want the original imageRef back so the pull falls back to the origin registry", invalidRef, got)
+	}
+}
+
+func TestNewRewriteHostPullCacheRequiresHost(t *testing.T) {
+	if _, err := NewRewriteHostPullCache(MirrorConfig{}); err == nil {
+		t.Fatal("NewRewriteHostPullCache with an empty host should return an error")
+	}
+}
+
+func TestRewriteHostPullCacheWarm(t *testing.T) {
+	var gotMethod, gotPath, gotAuthHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotPath = r.URL.Path
+		gotAuthHeader = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	cache, err := NewRewriteHostPullCache(MirrorConfig{Host: host, Insecure: true, Username: "mirror-user", Password: "mirror-pass"})
+	if err != nil {
+		t.Fatalf("NewRewriteHostPullCache returned error: %v", err)
+	}
+
+	if err := cache.Warm("nginx:latest", Auth{}); err != nil {
+		t.Fatalf("Warm returned error: %v", err)
+	}
+	if gotMethod != http.MethodHead {
+		t.Errorf("mirror received method %q, want %q", gotMethod, http.MethodHead)
+	}
+	if want := "/v2/library/nginx/manifests/latest"; gotPath != want {
+		t.Errorf("mirror received path %q, want %q", gotPath, want)
+	}
+	if gotAuthHeader == "" {
+		t.Error("mirror received no Authorization header, want the mirror's configured basic auth credential")
+	}
+}
+
+func TestRewriteHostPullCacheWarmPropagatesMirrorErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	cache, err := NewRewriteHostPullCache(MirrorConfig{Host: host, Insecure: true})
+	if err != nil {
+		t.Fatalf("NewRewriteHostPullCache returned error: %v", err)
+	}
+
+	if err := cache.Warm("nginx:latest", Auth{}); err == nil {
+		t.Fatal("Warm should return an error when the mirror responds with a failure status")
+	}
+}
+
+// TestPullThroughCacheSurvivesRefreshCache exercises the interaction the
+// chunk0-4 request called out explicitly: installing a PullThroughCache
+// must not change how refreshImageManagerCache expires auths, and a
+// recorded MirroredRef must survive a refresh pass that doesn't touch its
+// imageRef.
+func TestPullThroughCacheSurvivesRefreshCache(t *testing.T) {
+	cache := newImageManagerCache(t.TempDir(), nil)
+	if cache == nil {
+		t.Fatal("failed to create image manager cache")
+	}
+	cache.SetPullThroughCache(&rewriteHostPullCache{mirror: MirrorConfig{Host: "mirror.example.com:5000"}})
+
+	const imageRef = "nginx:latest"
+	auth := Auth{Username: "user", Password: "pass"}
+	if err := cache.setImagePullInfo(imageRef, auth, &EnsuredInfo{Ensured: true, LastEnsuredDate: time.Now()}); err != nil {
+		t.Fatalf("setImagePullInfo returned error: %v", err)
+	}
+
+	entry := cache.getImagePullInfo(imageRef)
+	if entry == nil {
+		t.Fatal("getImagePullInfo returned nil after setImagePullInfo")
+	}
+	if entry.MirroredRef == "" {
+		t.Fatal("MirroredRef was not recorded by setImagePullInfo with a PullThroughCache installed")
+	}
+
+	// recheckPeriod.Duration == 0 with recheck requested is a no-op by
+	// design; a non-zero period should leave a freshly-ensured auth alone.
+	if err := cache.refreshImageManagerCache(true, v1.Duration{Duration: time.Hour}); err != nil {
+		t.Fatalf("refreshImageManagerCache returned error: %v", err)
+	}
+
+	entry = cache.getImagePullInfo(imageRef)
+	if entry == nil {
+		t.Fatal("getImagePullInfo returned nil after refreshImageManagerCache")
+	}
+	if entry.MirroredRef == "" {
+		t.Error("refreshImageManagerCache cleared MirroredRef even though it didn't touch this imageRef's auths")
+	}
+}
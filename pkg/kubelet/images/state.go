@@ -42,6 +42,10 @@ type EnsuredInfo struct {
 	LastEnsuredDate time.Time `json:"lastEnsuredDate"`
 }
 
+// ImagePullInfo holds the state tracked for a single imageRef. Every entry
+// carries its own lock so that callers touching different imageRefs never
+// contend with one another; only inserting or removing an entry from the
+// cache requires the imageManagerCache-level lock.
 type ImagePullInfo struct {
 	// TODO: (mikebrow) time of last pull for this imageRef
 	// TODO: (mikebrow) time of pull for each particular auth hash
@@ -50,23 +54,44 @@ type ImagePullInfo struct {
 
 	// map of auths hash (keys) used to successfully pull this imageref
 	Auths map[string]*EnsuredInfo `json:"auths"`
+
+	// MirroredRef is the reference the cache's PullThroughCache last
+	// resolved this imageRef to. With the default passthrough cache this is
+	// the normalized imageRef itself. A Resolve call that fails leaves the
+	// previously recorded value in place.
+	MirroredRef string `json:"mirroredRef,omitempty"`
 }
 
 // reader interface used to retrieve image manager's cache
 type reader interface {
 	loadImageManagerCache(imageRef string) error
 	getImagePullInfo(imageRef string) (pullInfo *ImagePullInfo)
-	getAuthInfo(imageRef, hash string) (authInfo *EnsuredInfo)
+	getAuthInfo(imageRef string, auth Auth) (authInfo *EnsuredInfo)
 }
 
-// writer interface helps in updating the image manager's cache
+// writer interface helps in updating the image manager's cache.
+// storeImageManagerCache must persist data such that a reader never
+// observes a partial write (e.g. via lock + rename-into-place), since the
+// state file may be read by another process such as a checkpoint-restore
+// helper or a kubelet from a concurrent upgrade.
 type writer interface {
 	storeImageManagerCache(imageRef string) error
 	refreshImageManagerCache(recheck bool, recheckPeriod v1.Duration) error
-	setImagePullInfo(imageRef string, hash string, data *EnsuredInfo) error
+	setImagePullInfo(imageRef string, auth Auth, data *EnsuredInfo) error
 	deleteImagePullInfo(imageRef string) error
-	setAuthInfo(imageRef, hash string, data *EnsuredInfo)
-	deleteAuthInfo(imageRef, hash string)
+	setAuthInfo(imageRef string, auth Auth, data *EnsuredInfo)
+	deleteAuthInfo(imageRef string, auth Auth)
+	// AssociateDigest records that tagRef last resolved to digestRef, so a
+	// later getImagePullInfo/getAuthInfo lookup of tagRef still finds the
+	// entry stored under its digest. The caller driving the actual image
+	// pull (the CRI PullImage response reports the digest an imageRef
+	// resolved to) is expected to call this once the pull completes.
+	AssociateDigest(tagRef, digestRef string) error
+	// setPersistence swaps the on-disk persistence strategy store/load go
+	// through. An alternative backend must implement the persistence
+	// contract (see its doc comment in state_io.go) to be a drop-in
+	// replacement for the default flockAtomicPersistence.
+	setPersistence(p persistence)
 }
 
 // State interface provides methods for tracking and setting image manager cache
@@ -75,22 +100,87 @@ type State interface {
 	writer
 }
 
+// imageManagerCache keys ImagePullInfo entries by imageRef. lock only guards
+// inserting and removing entries from cache; reading or mutating an
+// individual entry's Auths (including persisting it to disk) goes through
+// that entry's own ImagePullInfo.mux instead, so pulls of unrelated images
+// never block on each other.
 type imageManagerCache struct {
 	lock  sync.RWMutex
 	cache ImagePullCacheMap
+	// digestByTag maps a normalized tag-form key (e.g.
+	// "index.docker.io/library/nginx:latest") to the normalized
+	// digest-form key it last resolved to, so a tag-based lookup still
+	// finds an entry that was stored under its digest. Guarded by lock.
+	digestByTag map[string]string
 	// imageStateManagerPath is the file path to store the image manager cache
 	imageStateManagerPath string
+	// pullThrough optionally fronts pulls with a node-local or
+	// cluster-local registry mirror. Defaults to passthroughPullCache,
+	// never nil. Guarded by lock.
+	pullThrough PullThroughCache
+	// hasher turns an Auth into the stable, salted hash used to key
+	// ImagePullInfo.Auths.
+	hasher *AuthHasher
+	// persist is the on-disk storage strategy for cache entries. Defaults
+	// to flockAtomicPersistence, never nil. Guarded by lock.
+	persist persistence
+}
+
+// setPersistence installs p as the cache's persistence strategy. Passing
+// nil restores the default flockAtomicPersistence.
+func (c *imageManagerCache) setPersistence(p persistence) {
+	if p == nil {
+		p = flockAtomicPersistence{}
+	}
+	c.lock.Lock()
+	c.persist = p
+	c.lock.Unlock()
+}
+
+// SetPullThroughCache installs p as the cache's pull-through backend.
+// Passing nil restores the default no-op passthrough.
+func (c *imageManagerCache) SetPullThroughCache(p PullThroughCache) {
+	if p == nil {
+		p = NewPassthroughPullCache()
+	}
+	c.lock.Lock()
+	c.pullThrough = p
+	c.lock.Unlock()
 }
 
 func newImageManagerCache(rootDir string, imageRefs []string) *imageManagerCache {
+	hasher, err := NewAuthHasher(rootDir)
+	if err != nil {
+		klog.Errorf("Failed to initialize image manager cache auth hasher: %v", err)
+		return nil
+	}
 	cache := &imageManagerCache{
 		cache:                 make(ImagePullCacheMap),
+		digestByTag:           make(map[string]string),
 		imageStateManagerPath: filepath.Join(rootDir, imageManagerstateFileName),
+		pullThrough:           NewPassthroughPullCache(),
+		hasher:                hasher,
+		persist:               flockAtomicPersistence{},
+	}
+	if err := os.MkdirAll(cache.imageStateManagerPath, 0700); err != nil {
+		klog.Errorf("Failed to create image manager cache directory %s: %v", cache.imageStateManagerPath, err)
+		return nil
+	}
+	// Clean up any tmpFilePrefix scratch file left behind by a write that was
+	// interrupted before its rename into place completed.
+	if err := recoverImageStateDir(cache.imageStateManagerPath); err != nil {
+		klog.Errorf("Failed to recover image manager cache directory %s: %v", cache.imageStateManagerPath, err)
+		return nil
 	}
 	// load the cache data from the disk
 	for _, imageRef := range imageRefs {
-		err := cache.loadImageManagerCache(imageRef)
+		key, err := NormalizeImageRef(imageRef)
 		if err != nil {
+			klog.Errorf("Failed to normalize image reference %s: %v", imageRef, err)
+			return nil
+		}
+		if err := cache.loadImageManagerCache(key); err != nil {
 			klog.Errorf("Failed to load image manager cache for image ref %s: %v", imageRef, err)
 			return nil
 		}
@@ -98,161 +188,316 @@ func newImageManagerCache(rootDir string, imageRefs []string) *imageManagerCache
 	return cache
 }
 
-func (c *imageManagerCache) getImagePullInfo(imageRef string) (pullInfo *ImagePullInfo) {
+// getOrLoadEntry returns the ImagePullInfo for imageRef, loading it from disk
+// under the cache lock if it isn't already resident in memory. It never
+// creates a new entry.
+func (c *imageManagerCache) getOrLoadEntry(imageRef string) *ImagePullInfo {
+	c.lock.RLock()
+	entry, ok := c.cache[imageRef]
+	c.lock.RUnlock()
+	if ok {
+		return entry
+	}
+
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	// load the data from the disk
-	c.loadImageManagerCache(imageRef)
-	if c.cache != nil {
-		if _, ok := c.cache[imageRef]; ok {
-			return c.cache[imageRef]
-		}
+	if entry, ok := c.cache[imageRef]; ok {
+		return entry
 	}
-	return nil
+	if err := c.loadImageManagerCacheLocked(imageRef); err != nil {
+		klog.Errorf("Failed to load image manager cache for image ref %s: %v", imageRef, err)
+		return nil
+	}
+	return c.cache[imageRef]
 }
 
-func (c *imageManagerCache) getAuthInfo(imageRef, hash string) (authInfo *EnsuredInfo) {
+func (c *imageManagerCache) getImagePullInfo(imageRef string) (pullInfo *ImagePullInfo) {
+	key, err := NormalizeImageRef(imageRef)
+	if err != nil {
+		klog.Errorf("Failed to normalize image reference %s: %v", imageRef, err)
+		return nil
+	}
+	if entry := c.getOrLoadEntry(key); entry != nil {
+		return entry
+	}
+	// This tag may have last been recorded under the digest it resolved
+	// to; fall back to that so the pull isn't treated as never-seen.
+	c.lock.RLock()
+	digestKey, ok := c.digestByTag[key]
+	c.lock.RUnlock()
+	if !ok {
+		return nil
+	}
+	return c.getOrLoadEntry(digestKey)
+}
 
-	pullInfo := c.getImagePullInfo(imageRef)
-	if pullInfo == nil {
+func (c *imageManagerCache) getAuthInfo(imageRef string, auth Auth) (authInfo *EnsuredInfo) {
+	entry := c.getImagePullInfo(imageRef)
+	if entry == nil {
 		return nil
 	}
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	c.cache[imageRef].mux.Lock()
-	defer c.cache[imageRef].mux.Unlock()
-	if _, ok := pullInfo.Auths[hash]; ok {
-		return c.cache[imageRef].Auths[hash]
+	hash, err := c.hasher.Hash(auth)
+	if err != nil {
+		klog.Errorf("Failed to hash auth for image ref %s: %v", imageRef, err)
+		return nil
 	}
-	return nil
+	entry.mux.RLock()
+	defer entry.mux.RUnlock()
+	return entry.Auths[hash]
 }
 
-func (c *imageManagerCache) setImagePullInfo(imageRef string, hash string, data *EnsuredInfo) error {
+func (c *imageManagerCache) setImagePullInfo(imageRef string, auth Auth, data *EnsuredInfo) error {
+	key, err := NormalizeImageRef(imageRef)
+	if err != nil {
+		return err
+	}
+	hash, err := c.hasher.Hash(auth)
+	if err != nil {
+		return err
+	}
+
 	c.lock.Lock()
-	defer c.lock.Unlock()
 	if c.cache == nil {
 		c.cache = make(ImagePullCacheMap)
 	}
-	authInfo := make(map[string]*EnsuredInfo)
-	authInfo[hash] = data
-	c.cache[imageRef] = &ImagePullInfo{Auths: authInfo}
-	return c.storeImageManagerCache(imageRef)
+	entry, ok := c.cache[key]
+	if !ok {
+		entry = &ImagePullInfo{Auths: make(map[string]*EnsuredInfo)}
+		c.cache[key] = entry
+	}
+	pullThrough := c.pullThrough
+	c.lock.Unlock()
+
+	entry.mux.Lock()
+	entry.Auths[hash] = data
+	entry.mux.Unlock()
+
+	if pullThrough != nil {
+		mirroredRef, err := pullThrough.Resolve(key, auth)
+		if err != nil {
+			// Fall back to the origin registry: leave MirroredRef as-is
+			// rather than fail the whole ensure-secret-pulled write.
+			klog.V(4).ErrorS(err, "Pull-through cache could not resolve a mirror, falling back to origin", "imageRef", key)
+		} else {
+			entry.mux.Lock()
+			entry.MirroredRef = mirroredRef
+			entry.mux.Unlock()
+		}
+	}
+
+	return c.storeImageManagerCache(key)
 }
 
 func (c *imageManagerCache) deleteImagePullInfo(imageRef string) error {
+	key, err := NormalizeImageRef(imageRef)
+	if err != nil {
+		return err
+	}
+
 	c.lock.Lock()
-	defer c.lock.Unlock()
 	if c.cache != nil {
-		delete(c.cache, imageRef)
+		delete(c.cache, key)
 	}
-	// Also delete from the disk
-	if err := os.Remove(filepath.Join(c.imageStateManagerPath, imageRef)); err != nil {
+	persist := c.persist
+	c.lock.Unlock()
+
+	// Also delete from disk, through the same persistence strategy (and its
+	// advisory lock) storeImageManagerCache/loadImageManagerCacheLocked use,
+	// so a swapped-in backend observes deletes too and a concurrent writer
+	// can't race the rename-into-place of a store against this delete.
+	path := filepath.Join(c.imageStateManagerPath, cacheFileName(key))
+	if err := persist.delete(path); err != nil {
 		klog.Errorf("Failed to delete image manager cache for image ref %s: %v", imageRef, err)
 		return err
 	}
 	return nil
 }
 
-func (c *imageManagerCache) setAuthInfo(imageRef, hash string, data *EnsuredInfo) {
+func (c *imageManagerCache) setAuthInfo(imageRef string, auth Auth, data *EnsuredInfo) {
+	key, err := NormalizeImageRef(imageRef)
+	if err != nil {
+		klog.Errorf("Failed to normalize image reference %s: %v", imageRef, err)
+		return
+	}
+	hash, err := c.hasher.Hash(auth)
+	if err != nil {
+		klog.Errorf("Failed to hash auth for image ref %s: %v", imageRef, err)
+		return
+	}
+
+	c.lock.Lock()
 	if c.cache == nil {
 		c.cache = make(ImagePullCacheMap)
 	}
-	auth := make(map[string]*EnsuredInfo)
-	auth[hash] = data
-	c.lock.Lock()
-	c.cache[imageRef] = &ImagePullInfo{Auths: auth}
+	entry, ok := c.cache[key]
+	if !ok {
+		entry = &ImagePullInfo{Auths: make(map[string]*EnsuredInfo)}
+		c.cache[key] = entry
+	}
 	c.lock.Unlock()
+
+	entry.mux.Lock()
+	entry.Auths[hash] = data
+	entry.mux.Unlock()
 }
 
-func (c *imageManagerCache) deleteAuthInfo(imageRef, hash string) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	if c.cache != nil {
-		if _, ok := c.cache[imageRef]; ok {
-			c.cache[imageRef].mux.Lock()
-			defer c.cache[imageRef].mux.Unlock()
-			if _, present := c.cache[imageRef].Auths[hash]; present {
-				delete(c.cache[imageRef].Auths, hash)
-			}
-		}
+func (c *imageManagerCache) deleteAuthInfo(imageRef string, auth Auth) {
+	hash, err := c.hasher.Hash(auth)
+	if err != nil {
+		klog.Errorf("Failed to hash auth for image ref %s: %v", imageRef, err)
+		return
+	}
+	key, err := NormalizeImageRef(imageRef)
+	if err != nil {
+		klog.Errorf("Failed to normalize image reference %s: %v", imageRef, err)
+		return
 	}
+	c.deleteAuthInfoByHash(key, hash)
 }
 
-func (c *imageManagerCache) storeImageManagerCache(imageRef string) error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	info := c.getImagePullInfo(imageRef)
-	if info == nil || imageRef == "" {
-		return nil
+// deleteAuthInfoByHash removes the Auths entry already keyed by hash,
+// without recomputing it from an Auth. Used internally where the hash is
+// already in hand, e.g. while sweeping expired entries in
+// refreshImageManagerCache.
+func (c *imageManagerCache) deleteAuthInfoByHash(key, hash string) {
+	c.lock.RLock()
+	entry, ok := c.cache[key]
+	c.lock.RUnlock()
+	if !ok {
+		return
 	}
-	// store the info to the disk
-	byteData, err := utiljson.Marshal(info)
+	entry.mux.Lock()
+	delete(entry.Auths, hash)
+	entry.mux.Unlock()
+}
+
+// AssociateDigest records that the tag-form reference tagRef last resolved
+// to digestRef, so a later lookup of tagRef finds the entry stored under
+// its digest. Callers (the kubelet image manager) call this once the CRI
+// pull response reports the digest an imageRef actually resolved to.
+func (c *imageManagerCache) AssociateDigest(tagRef, digestRef string) error {
+	tagKey, err := NormalizeImageRef(tagRef)
 	if err != nil {
 		return err
 	}
-	path := filepath.Join(c.imageStateManagerPath, imageRef)
-	err = os.WriteFile(path, byteData, 0644)
+	digestKey, err := NormalizeImageRef(digestRef)
 	if err != nil {
 		return err
 	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.digestByTag == nil {
+		c.digestByTag = make(map[string]string)
+	}
+	c.digestByTag[tagKey] = digestKey
 	return nil
 }
 
+func (c *imageManagerCache) storeImageManagerCache(imageRef string) error {
+	entry := c.getOrLoadEntry(imageRef)
+	if entry == nil || imageRef == "" {
+		return nil
+	}
+
+	entry.mux.RLock()
+	byteData, err := utiljson.Marshal(entry)
+	entry.mux.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	c.lock.RLock()
+	persist := c.persist
+	c.lock.RUnlock()
+
+	path := filepath.Join(c.imageStateManagerPath, cacheFileName(imageRef))
+	return persist.write(path, byteData, 0644)
+}
+
 func (c *imageManagerCache) loadImageManagerCache(imageRef string) error {
-	path := filepath.Join(c.imageStateManagerPath, imageRef)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.loadImageManagerCacheLocked(imageRef)
+}
+
+// loadImageManagerCacheLocked reads imageRef's on-disk state into c.cache.
+// Callers must hold c.lock for writing.
+func (c *imageManagerCache) loadImageManagerCacheLocked(imageRef string) error {
+	if imageRef == "" {
+		return nil
+	}
+	path := filepath.Join(c.imageStateManagerPath, cacheFileName(imageRef))
 	_, err := os.Stat(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
-		} else {
-			klog.ErrorS(err, "Failed to stat image manager cache file", "file", path)
-			return err
 		}
+		klog.ErrorS(err, "Failed to stat image manager cache file", "file", path)
+		return err
 	}
-	if imageRef == "" {
-		return nil
-	}
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	// load the info from the disk
-	byteData, err := os.ReadFile(path)
+
+	byteData, err := c.persist.read(path)
 	if err != nil {
 		return err
 	}
 	info := new(ImagePullInfo)
-	err = utiljson.Unmarshal(byteData, info)
-	if err != nil {
+	if err := utiljson.Unmarshal(byteData, info); err != nil {
 		return err
 	}
+	// An auth hashed under an unrecognized scheme (an older or newer
+	// kubelet, or a corrupted entry) can't be trusted to mean what it
+	// once did; drop it so the credential gets re-verified instead.
+	for hash := range info.Auths {
+		if !isSupportedAuthHash(hash) {
+			delete(info.Auths, hash)
+		}
+	}
 	c.cache[imageRef] = info
 	return nil
 }
 
+// refreshImageManagerCache drops auth entries whose recheck period has
+// elapsed. It only takes a snapshot of the cache under c.lock, then does the
+// actual expiry check and mutation per-entry so it never holds c.lock while
+// doing the (potentially slow) work of rewriting entries.
 func (c *imageManagerCache) refreshImageManagerCache(recheck bool, recheckPeriod v1.Duration) error {
-	var lock sync.RWMutex
-	lock.Lock()
-	defer lock.Unlock()
 	if recheck && recheckPeriod.Duration == 0 {
 		// Based on the design proposal of the enhancement, the kubelet is not supposed to invalidate the cache
 		// Reference: https://github.com/kubernetes/enhancements/tree/master/keps/sig-node/2535-ensure-secret-pulled-images#proposal
 		return nil
 	}
-	for k, v := range c.cache {
-		for i, auth := range v.Auths {
-			if auth != nil && auth.LastEnsuredDate.Add(recheckPeriod.Duration).Before(time.Now()) {
-				c.deleteAuthInfo(k, i)
-			}
-			/* TODO: When do we delete the metadata?
-			if len(v.Auths) == 0 {
-				delete(m.ensureSecretPulledImages, k)
-			}
-			*/
-			if err := c.setImagePullInfo(k, i, auth); err != nil {
-				klog.Errorf("Failed to set image pull info for image manager cache %s: %v", k, err)
-				return err
+
+	c.lock.RLock()
+	entries := make(map[string]*ImagePullInfo, len(c.cache))
+	for imageRef, entry := range c.cache {
+		entries[imageRef] = entry
+	}
+	c.lock.RUnlock()
+
+	now := time.Now()
+	for imageRef, entry := range entries {
+		entry.mux.RLock()
+		var expired []string
+		for hash, auth := range entry.Auths {
+			if auth != nil && auth.LastEnsuredDate.Add(recheckPeriod.Duration).Before(now) {
+				expired = append(expired, hash)
 			}
 		}
+		entry.mux.RUnlock()
+
+		if len(expired) == 0 {
+			continue
+		}
+		for _, hash := range expired {
+			c.deleteAuthInfoByHash(imageRef, hash)
+		}
+		// Persist the removal, or a restart before the next write would
+		// reload the on-disk copy and treat the expired auth as valid
+		// again, defeating the recheck period.
+		if err := c.storeImageManagerCache(imageRef); err != nil {
+			klog.Errorf("Failed to persist image manager cache after expiring auths for image ref %s: %v", imageRef, err)
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,205 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package images
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofrs/flock"
+	"k8s.io/klog/v2"
+)
+
+// tmpFilePrefix marks the scratch files atomicWriteFile stages its data in
+// before renaming them into place. newImageManagerCache sweeps and removes
+// any of these left behind in the image state directory by a kubelet that
+// crashed mid-write; temp files staged elsewhere (e.g. for the auth salt
+// file) are not swept.
+const tmpFilePrefix = ".tmp-"
+
+// dirLockFileName is the coarse, directory-wide lock used while recovering
+// the cache directory (e.g. cleaning up stray temp files) so a concurrent
+// kubelet (or a checkpoint-restore helper) can't observe a half-swept state.
+const dirLockFileName = ".dir.lock"
+
+// entryLockPath returns the advisory lock file path guarding reads and
+// writes of imageRef's on-disk state file.
+func entryLockPath(path string) string {
+	return path + ".lock"
+}
+
+// cacheFileName flattens a normalized "registry/repository:tag" (or
+// "...@digest") key into a single path segment. It must be a lossless
+// encoding: '/' and '_' are both legal characters in a Docker repository
+// path (e.g. "reg.io/foo/bar:tag" and "reg.io/foo_bar:tag" are distinct,
+// real references), so a plain "/" -> "_" substitution would collide two
+// unrelated images onto the same on-disk entry. base64 of the raw key has
+// no such collisions.
+func cacheFileName(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// persistence is the storage contract storeImageManagerCache and
+// loadImageManagerCacheLocked persist an entry's state through: writes must
+// never let a reader observe a partial write, and must cooperate with other
+// processes (another kubelet, a checkpoint-restore helper) touching the
+// same file via the advisory lock at entryLockPath(path). Alternative
+// backends plug in via imageManagerCache.setPersistence and must uphold the
+// same contract.
+type persistence interface {
+	write(path string, data []byte, perm os.FileMode) error
+	read(path string) ([]byte, error)
+	// delete removes path's data file, along with its entryLockPath lock
+	// file, under the same advisory lock write/read take. A missing data
+	// file is not an error.
+	delete(path string) error
+}
+
+// flockAtomicPersistence is the default persistence: cross-process
+// advisory locking plus a write-temp/fsync/rename/fsync-dir atomic write.
+type flockAtomicPersistence struct{}
+
+func (flockAtomicPersistence) write(path string, data []byte, perm os.FileMode) error {
+	return withFileLock(entryLockPath(path), true, func() error {
+		return atomicWriteFile(path, data, perm)
+	})
+}
+
+func (flockAtomicPersistence) read(path string) ([]byte, error) {
+	var data []byte
+	err := withFileLock(entryLockPath(path), false, func() error {
+		var readErr error
+		data, readErr = os.ReadFile(path)
+		return readErr
+	})
+	return data, err
+}
+
+func (flockAtomicPersistence) delete(path string) error {
+	lockPath := entryLockPath(path)
+	err := withFileLock(lockPath, true, func() error {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// The lock file itself is only scratch state for the entry; remove it
+	// now that there's no data file left to guard, so it doesn't leak.
+	if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// withFileLock takes the advisory lock at lockPath for the duration of fn.
+func withFileLock(lockPath string, exclusive bool, fn func() error) error {
+	fl := flock.New(lockPath)
+	var locked bool
+	var err error
+	if exclusive {
+		locked, err = fl.TryLock()
+	} else {
+		locked, err = fl.TryRLock()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %w", lockPath, err)
+	}
+	if !locked {
+		// Fall back to a blocking lock; Try* only fails fast, it doesn't
+		// mean the lock is unobtainable.
+		if exclusive {
+			err = fl.Lock()
+		} else {
+			err = fl.RLock()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to lock %s: %w", lockPath, err)
+		}
+	}
+	defer fl.Unlock()
+	return fn()
+}
+
+// atomicWriteFile writes data to path without ever leaving a reader able to
+// observe a partial write: it stages the content in a temp file in the same
+// directory, fsyncs it, renames it over path, and fsyncs the parent
+// directory so the rename itself is durable.
+func atomicWriteFile(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, tmpFilePrefix+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once the rename below succeeds
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
+
+// recoverImageStateDir removes any temp files left behind by a write that
+// was interrupted (kubelet restart, OOM-kill, etc.) before its rename could
+// complete. It runs under the directory's coarse lock so it never races a
+// concurrent kubelet doing the same recovery.
+func recoverImageStateDir(dir string) error {
+	return withFileLock(filepath.Join(dir, dirLockFileName), true, func() error {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		for _, entry := range entries {
+			if !strings.Contains(entry.Name(), tmpFilePrefix) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+				klog.ErrorS(err, "Failed to remove stray image manager cache temp file", "file", entry.Name())
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package images
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlockAtomicPersistenceRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "entry")
+	persist := flockAtomicPersistence{}
+
+	want := []byte(`{"auths":{}}`)
+	if err := persist.write(path, want, 0644); err != nil {
+		t.Fatalf("write returned error: %v", err)
+	}
+
+	got, err := persist.read(path)
+	if err != nil {
+		t.Fatalf("read returned error: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("read back %q, want %q", got, want)
+	}
+
+	// The data must have landed at path itself, not a stray temp file.
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("data file %s does not exist after write: %v", path, err)
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, tmpFilePrefix+"*"))
+	if err != nil {
+		t.Fatalf("Glob returned error: %v", err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("temp files left behind after write: %v", matches)
+	}
+
+	if err := persist.delete(path); err != nil {
+		t.Fatalf("delete returned error: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("data file %s still exists after delete: %v", path, err)
+	}
+	if _, err := os.Stat(entryLockPath(path)); !os.IsNotExist(err) {
+		t.Errorf("lock file %s still exists after delete: %v", entryLockPath(path), err)
+	}
+}
+
+// TestWithFileLockSerializesWriters drives eight goroutines through
+// withFileLock at once and asserts the critical section never runs
+// concurrently: a racy increment-then-sleep-then-check would otherwise
+// observe more than one goroutine inside at a time.
+func TestWithFileLockSerializesWriters(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "entry.lock")
+
+	var inCriticalSection int32
+	var sawOverlap int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := withFileLock(lockPath, true, func() error {
+				if atomic.AddInt32(&inCriticalSection, 1) > 1 {
+					atomic.StoreInt32(&sawOverlap, 1)
+				}
+				time.Sleep(time.Millisecond)
+				if atomic.LoadInt32(&inCriticalSection) > 1 {
+					atomic.StoreInt32(&sawOverlap, 1)
+				}
+				defer atomic.AddInt32(&inCriticalSection, -1)
+				return nil
+			})
+			if err != nil {
+				t.Errorf("withFileLock returned error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if atomic.LoadInt32(&sawOverlap) != 0 {
+		t.Error("two goroutines were inside withFileLock's critical section at once")
+	}
+}
+
+// TestRecoverImageStateDirRemovesStrayTempFiles covers the crash-recovery
+// path: a temp file left behind by an atomicWriteFile interrupted before
+// its rename-into-place must be swept on the next startup, while a real
+// cache entry is left alone.
+func TestRecoverImageStateDirRemovesStrayTempFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	strayTmp := filepath.Join(dir, tmpFilePrefix+"entry-12345")
+	if err := os.WriteFile(strayTmp, []byte("partial"), 0644); err != nil {
+		t.Fatalf("failed to seed stray temp file: %v", err)
+	}
+	realEntry := filepath.Join(dir, "entry")
+	if err := os.WriteFile(realEntry, []byte(`{"auths":{}}`), 0644); err != nil {
+		t.Fatalf("failed to seed real entry file: %v", err)
+	}
+
+	if err := recoverImageStateDir(dir); err != nil {
+		t.Fatalf("recoverImageStateDir returned error: %v", err)
+	}
+
+	if _, err := os.Stat(strayTmp); !os.IsNotExist(err) {
+		t.Errorf("stray temp file %s was not removed: %v", strayTmp, err)
+	}
+	if _, err := os.Stat(realEntry); err != nil {
+		t.Errorf("real entry file %s was removed or is unreadable: %v", realEntry, err)
+	}
+}